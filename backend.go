@@ -0,0 +1,82 @@
+package cfgul
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// pipeWriter adapts an upload function that wants an io.Reader (as used by
+// the AWS, Azure and Aliyun SDKs) to the io.WriteCloser shape Backend needs.
+// Writes are streamed through an in-memory pipe into a goroutine running
+// upload; Close blocks until that goroutine has finished and returns any
+// error it produced.
+type pipeWriter struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func newPipeWriter(upload func(io.Reader) error) *pipeWriter {
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- upload(pr)
+	}()
+	return &pipeWriter{pw: pw, done: done}
+}
+
+func (w *pipeWriter) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+func (w *pipeWriter) Close() error {
+	if err := w.pw.Close(); err != nil {
+		return err
+	}
+	return <-w.done
+}
+
+// Backend is the storage abstraction used for reading the input uri-list and
+// writing/deleting WARC output objects. It is modelled on the storage driver
+// pattern used by docker/distribution's registry package: implementations
+// register themselves against a URL scheme, and callers look them up via
+// that scheme rather than depending on a concrete cloud SDK.
+type Backend interface {
+	// NewReader returns a reader for the object called name.
+	NewReader(ctx context.Context, name string) (io.ReadCloser, error)
+	// NewWriter returns a writer for the object called name.
+	NewWriter(ctx context.Context, name string) io.WriteCloser
+	// Delete removes the object called name.
+	Delete(ctx context.Context, name string) error
+}
+
+// BackendFactory constructs a Backend from a scheme-stripped location
+// (bucket name, container name, directory path, etc).
+type BackendFactory func(ctx context.Context, location string) (Backend, error)
+
+// backendFactories holds the registered factories, keyed by URL scheme
+// (without the trailing "://").
+var backendFactories = make(map[string]BackendFactory)
+
+// RegisterBackend registers factory under scheme, so that ParseBackendURL
+// can resolve locations of the form "<scheme>://<location>" to it.
+// Intended to be called from the init() of each backend implementation.
+func RegisterBackend(scheme string, factory BackendFactory) {
+	backendFactories[scheme] = factory
+}
+
+// ParseBackendURL splits rawurl into a scheme and location, and constructs
+// the Backend registered for that scheme. rawurl is expected to be of the
+// form "<scheme>://<location>", e.g. "gs://my-bucket" or "file:///var/spool".
+func ParseBackendURL(ctx context.Context, rawurl string) (Backend, error) {
+	scheme, location, ok := strings.Cut(rawurl, "://")
+	if !ok {
+		return nil, fmt.Errorf("invalid backend url %q: missing scheme", rawurl)
+	}
+	factory, ok := backendFactories[scheme]
+	if !ok {
+		return nil, fmt.Errorf("invalid backend url %q: unknown scheme %q", rawurl, scheme)
+	}
+	return factory(ctx, location)
+}
@@ -0,0 +1,79 @@
+package cfgul
+
+import (
+	"context"
+	"fmt"
+	"io"
+	neturl "net/url"
+	"os"
+	"strings"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+func init() {
+	RegisterBackend("az", newAzureBackend)
+}
+
+// splitAccountContainer splits an "<account>/<container>" location (as found
+// in an az://account/container URL) into its two parts.
+func splitAccountContainer(location string) (account, container string, err error) {
+	account, container, ok := strings.Cut(location, "/")
+	if !ok || account == "" || container == "" {
+		return "", "", fmt.Errorf("invalid azure location %q: expected <account>/<container>", location)
+	}
+	return account, container, nil
+}
+
+// azureBackend is the Backend implementation backed by an Azure Blob Storage
+// container, for use when running as an Azure Function. containerName is
+// expected to be in "<account>/<container>" form, matching az:// URLs such
+// as "az://myaccount/mycontainer". The account key is taken from the
+// AZURE_STORAGE_ACCOUNT_KEY environment variable.
+type azureBackend struct {
+	container azblob.ContainerURL
+}
+
+func newAzureBackend(ctx context.Context, containerName string) (Backend, error) {
+	account, container, err := splitAccountContainer(containerName)
+	if err != nil {
+		return nil, err
+	}
+	accountKey := os.Getenv("AZURE_STORAGE_ACCOUNT_KEY")
+	if accountKey == "" {
+		return nil, fmt.Errorf("AZURE_STORAGE_ACCOUNT_KEY not set in environment")
+	}
+	credential, err := azblob.NewSharedKeyCredential(account, accountKey)
+	if err != nil {
+		return nil, err
+	}
+	pipeline := azblob.NewPipeline(credential, azblob.PipelineOptions{})
+	containerURL, err := neturl.Parse(fmt.Sprintf("https://%s.blob.core.windows.net/%s", account, container))
+	if err != nil {
+		return nil, err
+	}
+	return &azureBackend{container: azblob.NewContainerURL(*containerURL, pipeline)}, nil
+}
+
+func (b *azureBackend) NewReader(ctx context.Context, name string) (io.ReadCloser, error) {
+	blob := b.container.NewBlockBlobURL(name)
+	resp, err := blob.Download(ctx, 0, azblob.CountToEnd, azblob.BlobAccessConditions{}, false, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body(azblob.RetryReaderOptions{}), nil
+}
+
+func (b *azureBackend) NewWriter(ctx context.Context, name string) io.WriteCloser {
+	blob := b.container.NewBlockBlobURL(name)
+	return newPipeWriter(func(r io.Reader) error {
+		_, err := azblob.UploadStreamToBlockBlob(ctx, r, blob, azblob.UploadStreamToBlockBlobOptions{})
+		return err
+	})
+}
+
+func (b *azureBackend) Delete(ctx context.Context, name string) error {
+	blob := b.container.NewBlockBlobURL(name)
+	_, err := blob.Delete(ctx, azblob.DeleteSnapshotsOptionNone, azblob.BlobAccessConditions{})
+	return err
+}
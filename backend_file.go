@@ -0,0 +1,52 @@
+package cfgul
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+func init() {
+	RegisterBackend("file", newFileBackend)
+}
+
+// fileBackend is the Backend implementation backed by the local filesystem,
+// for running as a standalone CLI against local disk rather than a cloud
+// object store. dir is the directory objects are read from/written to;
+// it is created on first write if it doesn't already exist.
+type fileBackend struct {
+	dir string
+}
+
+func newFileBackend(ctx context.Context, dir string) (Backend, error) {
+	return &fileBackend{dir: dir}, nil
+}
+
+func (b *fileBackend) NewReader(ctx context.Context, name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(b.dir, name))
+}
+
+func (b *fileBackend) NewWriter(ctx context.Context, name string) io.WriteCloser {
+	path := filepath.Join(b.dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return &errWriteCloser{err: err}
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return &errWriteCloser{err: err}
+	}
+	return f
+}
+
+func (b *fileBackend) Delete(ctx context.Context, name string) error {
+	return os.Remove(filepath.Join(b.dir, name))
+}
+
+// errWriteCloser is a no-op io.WriteCloser that returns err from every call,
+// used so NewWriter (which has no error return, matching storage.Writer) can
+// still surface a setup failure to the first Write/Close.
+type errWriteCloser struct{ err error }
+
+func (w *errWriteCloser) Write(p []byte) (int, error) { return 0, w.err }
+func (w *errWriteCloser) Close() error                { return w.err }
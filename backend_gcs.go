@@ -0,0 +1,46 @@
+package cfgul
+
+import (
+	"context"
+	"io"
+
+	"cloud.google.com/go/storage"
+)
+
+func init() {
+	RegisterBackend("gs", newGCSBackend)
+}
+
+// gcsBackend is the Backend implementation backed by a Google Cloud Storage
+// bucket. It is the original (and default) backend, used so that existing
+// Cloud Functions deployments keep working unchanged.
+type gcsBackend struct {
+	bucket *storage.BucketHandle
+}
+
+func newGCSBackend(ctx context.Context, bucketName string) (Backend, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &gcsBackend{bucket: client.Bucket(bucketName)}, nil
+}
+
+// newGCSBackendFromClient wraps an already-instantiated *storage.Client,
+// allowing callers (and tests) to supply their own client, e.g. one built
+// with option.WithHTTPClient pointing at a fake-gcs-server.
+func newGCSBackendFromClient(client *storage.Client, bucketName string) Backend {
+	return &gcsBackend{bucket: client.Bucket(bucketName)}
+}
+
+func (b *gcsBackend) NewReader(ctx context.Context, name string) (io.ReadCloser, error) {
+	return b.bucket.Object(name).NewReader(ctx)
+}
+
+func (b *gcsBackend) NewWriter(ctx context.Context, name string) io.WriteCloser {
+	return b.bucket.Object(name).NewWriter(ctx)
+}
+
+func (b *gcsBackend) Delete(ctx context.Context, name string) error {
+	return b.bucket.Object(name).Delete(ctx)
+}
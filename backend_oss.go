@@ -0,0 +1,46 @@
+package cfgul
+
+import (
+	"context"
+	"io"
+	"os"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+)
+
+func init() {
+	RegisterBackend("oss", newOSSBackend)
+}
+
+// ossBackend is the Backend implementation backed by an Aliyun OSS bucket.
+// Credentials and the endpoint are taken from the standard Aliyun
+// environment variables (OSS_ENDPOINT, OSS_ACCESS_KEY_ID, OSS_ACCESS_KEY_SECRET).
+type ossBackend struct {
+	bucket *oss.Bucket
+}
+
+func newOSSBackend(ctx context.Context, bucketName string) (Backend, error) {
+	client, err := oss.New(os.Getenv("OSS_ENDPOINT"), os.Getenv("OSS_ACCESS_KEY_ID"), os.Getenv("OSS_ACCESS_KEY_SECRET"))
+	if err != nil {
+		return nil, err
+	}
+	bucket, err := client.Bucket(bucketName)
+	if err != nil {
+		return nil, err
+	}
+	return &ossBackend{bucket: bucket}, nil
+}
+
+func (b *ossBackend) NewReader(ctx context.Context, name string) (io.ReadCloser, error) {
+	return b.bucket.GetObject(name)
+}
+
+func (b *ossBackend) NewWriter(ctx context.Context, name string) io.WriteCloser {
+	return newPipeWriter(func(r io.Reader) error {
+		return b.bucket.PutObject(name, r)
+	})
+}
+
+func (b *ossBackend) Delete(ctx context.Context, name string) error {
+	return b.bucket.DeleteObject(name)
+}
@@ -0,0 +1,67 @@
+package cfgul
+
+import (
+	"context"
+	"io"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+func init() {
+	RegisterBackend("s3", newS3Backend)
+}
+
+// s3Backend is the Backend implementation backed by an AWS S3 bucket, for
+// use when running as a Lambda function (or anywhere else AWS credentials
+// are available via the standard SDK credential chain).
+type s3Backend struct {
+	client   *s3.S3
+	uploader *s3manager.Uploader
+	bucket   string
+}
+
+func newS3Backend(ctx context.Context, bucketName string) (Backend, error) {
+	sess, err := session.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	client := s3.New(sess)
+	return &s3Backend{
+		client:   client,
+		uploader: s3manager.NewUploaderWithClient(client),
+		bucket:   bucketName,
+	}, nil
+}
+
+func (b *s3Backend) NewReader(ctx context.Context, name string) (io.ReadCloser, error) {
+	out, err := b.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(name),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+func (b *s3Backend) NewWriter(ctx context.Context, name string) io.WriteCloser {
+	return newPipeWriter(func(r io.Reader) error {
+		_, err := b.uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+			Bucket: aws.String(b.bucket),
+			Key:    aws.String(name),
+			Body:   r,
+		})
+		return err
+	})
+}
+
+func (b *s3Backend) Delete(ctx context.Context, name string) error {
+	_, err := b.client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(name),
+	})
+	return err
+}
@@ -9,15 +9,36 @@ response object per requested URL. Objects can be named in various ways, but
 default to using the SHA1 hash of the requested URL.
 
 Configuration environment variables:
-- GUL_OUTPUT_BUCKET - GCS Bucket name to write to (required)
+- GUL_OUTPUT_BUCKET - bucket/container/directory to write to (required)
+- GUL_OUTPUT_BACKEND - scheme of the backend to write output to, one of
+  "gs", "s3", "az", "oss", "file" (default: "gs", so existing Cloud
+  Functions deployments are unaffected)
+- GUL_INPUT_BACKEND - scheme of the backend the input uri-list itself lives
+  on (default: "gs"); this need not match GUL_OUTPUT_BACKEND
 - GUL_NAME_FORMAT - GCS Object name format, one of:
   - "sha1" - output filename is the sha1 hash of the requested url (default)
   - "url" - output filename is the (path-escaped) requested url
   - "hostname" - output filename is the hostname from the requested url
     (but beware of collisions!)
 - GUL_CONCURRENCY - how many requests to have in flight concurrently (default: 3)
-- GUL_SLEEP_SECONDS - how long to sleep between requests (float, default 0.0;
-  required primarily if you're hitting the same server repeatedly, to be polite)
+- GUL_HOST_RPS - requests per second to allow to any one host (float,
+  default 0.0 i.e. unlimited); replaces the old GUL_SLEEP_SECONDS, since a
+  single global sleep was either too slow across many hosts or too fast
+  against one busy host
+- GUL_HOST_BURST - how many requests to a single host may burst above
+  GUL_HOST_RPS before being throttled (default: 1)
+- GUL_GLOBAL_RPS - requests per second to allow overall, across all hosts
+  (float, default 0.0 i.e. unlimited)
+- GUL_RESPECT_ROBOTS - if "true", fetch and honour each host's robots.txt
+  before fetching from it, skipping disallowed URLs (default: false)
+- GUL_MAX_ATTEMPTS - how many times to attempt each URL before giving up and
+  recording a synthetic 599 (default: 3)
+- GUL_RETRY_MIN_DELAY - initial delay between attempts, as a Go duration
+  string e.g. "1s" (default: "1s")
+- GUL_RETRY_MAX_DELAY - cap on the (doubling) delay between attempts, as a
+  Go duration string (default: "30s")
+- GUL_RETRY_JITTER - fraction of the delay to randomly vary by, e.g. 0.2
+  for +/-20% (default: 0.2)
 */
 
 package cfgul
@@ -37,25 +58,29 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
-	"cloud.google.com/go/storage"
 	"github.com/gavincarr/warc"
 )
 
 // Config defaults
 const (
-	GUL_NAME_FORMAT   = "sha1"
-	GUL_CONCURRENCY   = 3
-	GUL_SLEEP_SECONDS = 0.0
+	GUL_NAME_FORMAT    = "sha1"
+	GUL_CONCURRENCY    = 3
+	GUL_INPUT_BACKEND  = "gs"
+	GUL_OUTPUT_BACKEND = "gs"
 )
 
 // Config holds our configuration settings
 type Config struct {
-	OutputBucket string
-	NameFormat   string
-	Concurrency  int
-	SleepSeconds float64
+	OutputBucket  string
+	NameFormat    string
+	Concurrency   int
+	InputBackend  string
+	OutputBackend string
+	Retry         RetryConfig
+	RateLimit     RateLimitConfig
 }
 
 // GCSEvent is the payload of a GCS finalize event
@@ -71,14 +96,23 @@ type GCSEvent struct {
 // newConfig returns a Config object based on the environment and defaults
 func newConfig() Config {
 	config := Config{
-		NameFormat:   GUL_NAME_FORMAT,
-		Concurrency:  GUL_CONCURRENCY,
-		SleepSeconds: GUL_SLEEP_SECONDS,
+		NameFormat:    GUL_NAME_FORMAT,
+		Concurrency:   GUL_CONCURRENCY,
+		InputBackend:  GUL_INPUT_BACKEND,
+		OutputBackend: GUL_OUTPUT_BACKEND,
+		Retry:         newRetryConfig(),
+		RateLimit:     newRateLimitConfig(),
 	}
 	config.OutputBucket = os.Getenv("GUL_OUTPUT_BUCKET")
 	if config.OutputBucket == "" {
 		log.Fatal("GUL_OUTPUT_BUCKET not set in environment - aborting")
 	}
+	if inputBackend := os.Getenv("GUL_INPUT_BACKEND"); inputBackend != "" {
+		config.InputBackend = inputBackend
+	}
+	if outputBackend := os.Getenv("GUL_OUTPUT_BACKEND"); outputBackend != "" {
+		config.OutputBackend = outputBackend
+	}
 	if nameFormat := os.Getenv("GUL_NAME_FORMAT"); nameFormat != "" {
 		if nameFormat != "sha1" && nameFormat != "url" && nameFormat != "hostname" {
 			log.Printf("Warning: invalid GUL_NAME_FORMAT value %q - using default %q\n",
@@ -95,14 +129,6 @@ func newConfig() Config {
 		log.Printf("Concurrency: %d\n", concurrency)
 		config.Concurrency = concurrency
 	}
-	if sleepSecStr := os.Getenv("GUL_SLEEP_SECONDS"); sleepSecStr != "" {
-		sleepSeconds, err := strconv.ParseFloat(sleepSecStr, 64)
-		if err != nil {
-			log.Fatalf("parsing GUL_SLEEP_SECONDS %q: %s\n", sleepSecStr, err)
-		}
-		log.Printf("Sleep seconds: %f\n", sleepSeconds)
-		config.SleepSeconds = sleepSeconds
-	}
 	return config
 }
 
@@ -116,12 +142,10 @@ func parsePrefix(name string) string {
 	return strings.Join(tokens[:len(tokens)-1], "/")
 }
 
-// fetchUrls reads the input bucket object called name, and returns a slice of the *url.URLs
+// fetchUrls reads the input backend object called name, and returns a slice of the *url.URLs
 // it contains. Invalid URLs (parse failures) are skipped/dropped.
-func fetchUrls(ctx context.Context, bucket *storage.BucketHandle, name string) []*neturl.URL {
-	obj := bucket.Object(name)
-
-	rdr, err := obj.NewReader(ctx)
+func fetchUrls(ctx context.Context, backend Backend, name string) []*neturl.URL {
+	rdr, err := backend.NewReader(ctx, name)
 	if err != nil {
 		log.Fatalf("creating reader for object %q: %s\n", name, err)
 	}
@@ -171,77 +195,180 @@ func objectName(nameFormat string, url *neturl.URL) string {
 	return filename + ".warc.gz"
 }
 
-func wrapBufferWARC(content *bytes.Buffer, urlstr string) (*bytes.Buffer, error) {
-	b := bytes.Buffer{}
-
-	gzwriter := gzip.NewWriter(&b)
-	writer := warc.NewWriter(gzwriter)
-
-	record := warc.NewRecord()
-	record.Header.Set("warc-type", "response")
-	record.Header.Set("content-type", "application/http;msgtype=response")
-	record.Header.Set("warc-target-uri", urlstr)
-	record.Content = content
-
-	if _, err := writer.WriteRecord(record); err != nil {
-		return nil, err
+// errorWARC builds a WARC buffer carrying a synthetic HTTP status line, for
+// use when every attempt failed to produce a real response. Each prior
+// attempt is preserved as an X-Attempt header line. reqSnapshot is nil when
+// no request was ever sent (e.g. urlStr failed to even parse into a
+// request), in which case no request record is written; otherwise the
+// response record references it via WARC-Concurrent-To, same as a
+// successful fetch.
+func errorWARC(sourceURIList, urlStr, status string, cause error, attempts []attemptResult, reqSnapshot *requestSnapshot) (*bytes.Buffer, error) {
+	var content bytes.Buffer
+	content.WriteString(status + "\r\n")
+	for _, a := range attempts {
+		content.WriteString("X-Attempt: " + a.String() + "\r\n")
 	}
-	if err := gzwriter.Close(); err != nil {
-		return nil, err
+	content.WriteString("Error: " + cause.Error() + "\r\n")
+	content.WriteString("\r\n")
+
+	records := []*warc.Record{newWarcinfoRecord(sourceURIList)}
+	var reqRecordID string
+	if reqSnapshot != nil {
+		var reqRecord *warc.Record
+		reqRecord, reqRecordID = newRequestRecord(reqSnapshot, "")
+		records = append(records, reqRecord)
 	}
-
-	return &b, nil
+	records = append(records, newResponseRecord(&content, nil, urlStr, "", reqRecordID))
+	return writeWARC(records...)
 }
 
-// getHTTP does a GET on url and returns a buffer with the final response in WARC format.
-// Errors (whether HTTP or connection errors) are captured as HTTP headers.
-func getHTTP(reqCtx context.Context, client *http.Client, url *neturl.URL) (*bytes.Buffer, error) {
-	content := bytes.Buffer{}
+// robotsDeniedWARC builds a WARC buffer holding a warcinfo record and a
+// response record carrying a synthetic "999 Robots Denied" status, for URLs
+// skipped under GUL_RESPECT_ROBOTS before any request is ever built - there
+// is nothing to put in a request record.
+func robotsDeniedWARC(sourceURIList, urlStr string) (*bytes.Buffer, error) {
+	var content bytes.Buffer
+	content.WriteString("HTTP/1.0 999 Robots Denied\r\n")
+	content.WriteString("\r\n")
+	record := newResponseRecord(&content, nil, urlStr, "", "")
+	return writeWARC(newWarcinfoRecord(sourceURIList), record)
+}
 
+// getHTTP does a GET on url, retrying per retry, and returns a buffer
+// containing the request and (final, post-redirect) response as a
+// conformant WARC 1.1 file, prefixed with a warcinfo record naming
+// sourceURIList, plus the number of attempts it took. Only once every
+// attempt has failed is a synthetic 599 recorded instead.
+func getHTTP(reqCtx context.Context, client *http.Client, resolver *hostResolver, retry RetryConfig, url *neturl.URL, sourceURIList string) (*bytes.Buffer, int, error) {
 	urlStr := url.String()
 	//log.Printf("++ doing GET for %q\n", urlStr)
 	req, err := http.NewRequest("GET", urlStr, nil)
 	if err != nil {
-		// Request error
-		content.WriteString("HTTP/1.0 599 Request Error\r\n")
-		content.WriteString("Error: " + err.Error() + "\r\n")
-		content.WriteString("\r\n")
-		return wrapBufferWARC(&content, urlStr)
+		// Request error - not worth retrying, it'll never parse
+		data, err := errorWARC(sourceURIList, urlStr, "HTTP/1.0 599 Request Error", err, nil, nil)
+		return data, 0, err
 	}
-	resp, err := client.Do(req.WithContext(reqCtx))
+	req.Header.Set("User-Agent", geturilistUserAgent)
+
+	reqSnapshot, err := snapshotRequest(req)
 	if err != nil {
-		// Connection error
-		content.WriteString("HTTP/1.0 599 Connection Error\r\n")
-		content.WriteString("Error: " + err.Error() + "\r\n")
-		content.WriteString("\r\n")
-		return wrapBufferWARC(&content, urlStr)
+		return nil, 0, err
+	}
+
+	// Use a per-request copy of client so CheckRedirect doesn't race across
+	// concurrent GETs; it still shares the underlying Transport.
+	c := *client
+	c.CheckRedirect = func(r *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return fmt.Errorf("stopped after %d redirects", len(via))
+		}
+		return nil
+	}
+
+	maxAttempts := retry.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	delay := retry.MinDelay
+	var attempts []attemptResult
+	var lastErr error
+
+	for n := 1; n <= maxAttempts; n++ {
+		if reqCtx.Err() != nil {
+			lastErr = reqCtx.Err()
+			break
+		}
+
+		attemptCtx, cancel := context.WithTimeout(reqCtx, attemptTimeout)
+		resp, body, err := doAttempt(attemptCtx, &c, req)
+		cancel()
+
+		if err != nil {
+			attempts = append(attempts, attemptResult{n: n, err: err})
+			lastErr = err
+			if n == maxAttempts || !retryableError(err, attemptCtx) {
+				break
+			}
+			sleep(reqCtx, delay)
+			delay = nextDelay(delay, retry.MaxDelay, retry.Jitter)
+			continue
+		}
+
+		attempts = append(attempts, attemptResult{n: n, status: resp.Status})
+		retry5xx, retryAfter := retryableStatus(resp)
+		if !retry5xx || n == maxAttempts {
+			data, err := finishResponse(resp, body, reqSnapshot, resolver, sourceURIList, attempts)
+			return data, len(attempts), err
+		}
+		lastErr = fmt.Errorf("retryable response: %s", resp.Status)
+		if retryAfter > 0 {
+			delay = retryAfter
+		}
+		sleep(reqCtx, delay)
+		delay = nextDelay(delay, retry.MaxDelay, retry.Jitter)
+	}
+
+	data, err := errorWARC(sourceURIList, urlStr, "HTTP/1.0 599 Connection Error", lastErr, attempts, reqSnapshot)
+	return data, len(attempts), err
+}
+
+// doAttempt performs a single GET attempt, returning the response and its
+// fully-read body (so it can be re-attached for serialization) or an error.
+func doAttempt(attemptCtx context.Context, client *http.Client, req *http.Request) (*http.Response, []byte, error) {
+	resp, err := client.Do(req.Clone(attemptCtx))
+	if err != nil {
+		return nil, nil, err
 	}
 	defer resp.Body.Close()
 
-	err = resp.Write(&content)
+	body, err := io.ReadAll(resp.Body)
 	if err != nil {
+		return nil, nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	return resp, body, nil
+}
+
+// finishResponse builds the WARC request+response records for a successful
+// attempt, tagging the response with an X-Attempt header for every attempt
+// (including this last, successful one) that preceded it.
+func finishResponse(resp *http.Response, body []byte, reqSnapshot *requestSnapshot, resolver *hostResolver, sourceURIList string, attempts []attemptResult) (*bytes.Buffer, error) {
+	for _, a := range attempts {
+		resp.Header.Add("X-Attempt", a.String())
+	}
+
+	var respContent bytes.Buffer
+	if err := resp.Write(&respContent); err != nil {
 		return nil, err
 	}
 
-	return wrapBufferWARC(&content, urlStr)
+	targetURI := resp.Request.URL.String()
+	ip := resolver.resolve(resp.Request.URL.Hostname())
+
+	reqRecord, reqRecordID := newRequestRecord(reqSnapshot, ip)
+	respRecord := newResponseRecord(&respContent, body, targetURI, ip, reqRecordID)
+
+	return writeWARC(newWarcinfoRecord(sourceURIList), reqRecord, respRecord)
 }
 
-// saveObject writes data to a GCS object called name
-func saveObject(ctx context.Context, bucket *storage.BucketHandle, prefix, name string, data *bytes.Buffer) {
+// saveObject writes data to a backend object called name, returning the
+// number of bytes written and any write or close error encountered.
+func saveObject(ctx context.Context, backend Backend, prefix, name string, data *bytes.Buffer) (int64, error) {
 	fullname := name
 	if prefix != "" {
 		fullname = prefix + "/" + name
 	}
-	obj := bucket.Object(fullname)
-	w := obj.NewWriter(ctx)
-	defer w.Close()
-	io.Copy(w, data)
+	w := backend.NewWriter(ctx, fullname)
+	n, err := io.Copy(w, data)
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	return n, err
 }
 
-// deleteObject deletes the (input) bucket GCS object called name (on run completion)
-func deleteObject(ctx context.Context, bucket *storage.BucketHandle, name string) {
-	obj := bucket.Object(name)
-	err := obj.Delete(ctx)
+// deleteObject deletes the (input) backend object called name (on run completion)
+func deleteObject(ctx context.Context, backend Backend, name string) {
+	err := backend.Delete(ctx, name)
 	if err != nil {
 		log.Fatalf("deleting object %q failed: %s\n", name, err)
 	}
@@ -249,76 +376,152 @@ func deleteObject(ctx context.Context, bucket *storage.BucketHandle, name string
 
 // GetURIList is our GCS Cloud Function entrypoint.
 func GetURIList(ctx context.Context, e GCSEvent) error {
+	_, err := NewHandler().RunWithStats(ctx, e)
+	return err
+}
+
+// Run processes e exactly as RunWithStats does, discarding the resulting
+// RunStats; it exists to keep the common case (running as a Cloud Function)
+// a plain func(ctx, GCSEvent) error.
+func (h *Handler) Run(ctx context.Context, e GCSEvent) error {
+	_, err := h.RunWithStats(ctx, e)
+	return err
+}
+
+// RunWithStats processes e: it fetches the input uri-list, fetches each URL
+// it contains, and saves the (final) response to the output backend in WARC
+// format, using the storage and HTTP clients configured on h. It returns
+// metrics for the run, for callers outside GCF to log or export.
+func (h *Handler) RunWithStats(ctx context.Context, e GCSEvent) (*RunStats, error) {
 	log.SetFlags(0)
 	log.Printf("%s execution started\n", e.Name)
+	stats := &RunStats{}
 
 	// Only handle objects that end in '.txt(.gz)?'
 	reTxt := regexp.MustCompile(`.txt(\.gz)?$`)
 	if !reTxt.MatchString(e.Name) {
 		log.Printf("skipping non-uri file %q\n", e.Name)
-		return nil
+		return stats, nil
 	}
 
-	config := newConfig()
+	config := h.Config
 	prefix := parsePrefix(e.Name)
 
-	storageClient, err := storage.NewClient(ctx)
+	backendIn, err := h.backend(ctx, config.InputBackend, e.Bucket)
 	if err != nil {
-		log.Fatalf("instantiating storage client: %s\n", err)
+		log.Fatalf("instantiating input backend: %s\n", err)
+	}
+	backendOut, err := h.backend(ctx, config.OutputBackend, config.OutputBucket)
+	if err != nil {
+		log.Fatalf("instantiating output backend: %s\n", err)
 	}
-
-	bucketIn := storageClient.Bucket(e.Bucket)
-	bucketOut := storageClient.Bucket(config.OutputBucket)
 
 	// Fetch the input object and parse as a text/uri-list
-	urls := fetchUrls(ctx, bucketIn, e.Name)
+	urls := fetchUrls(ctx, backendIn, e.Name)
 	log.Printf("URL count: %d\n", len(urls))
 
-	//httpClient := http.Client{Timeout: 10 * time.Second}
-	httpClient := http.Client{}
-	sem := make(chan struct{}, config.Concurrency)
-	sleep := time.Duration(config.SleepSeconds) * time.Second
-	line := 0
-	for _, url := range urls {
-		name := objectName(config.NameFormat, url)
-
-		if line%100 == 0 {
-			log.Printf("%s [%d] %s\n", e.Name, line, url.String())
-		}
+	resolver := newHostResolver()
+	limiter := newHostLimiter(config.RateLimit)
+	var robots *robotsCache
+	if config.RateLimit.RespectRobots {
+		robots = newRobotsCache(h.HTTPClient)
+	}
 
-		// Blocks until a sem slot is available
-		sem <- struct{}{}
-		go func(name string, url *neturl.URL) {
-			defer func() { <-sem }() // Release our sem slot
-			reqCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
-			defer cancel()
-			// getHTTP almost always returns success - most errors are captured in data
-			data, err := getHTTP(reqCtx, &httpClient, url)
+	// process handles one URL. Failures here are specific to that URL alone
+	// (a bad response, a transient write error) and must never take down
+	// the rest of the run, so process always returns nil - failures are
+	// only ever logged and counted in stats.Failed. The only thing that
+	// legitimately stops every worker is ctx itself being cancelled (the
+	// Cloud Functions runtime timing us out, or a caller-driven cancel),
+	// which each worker already observes directly via ctx.Done().
+	process := func(ctx context.Context, job fetchJob, stats *RunStats) error {
+		reqCtx, cancel := context.WithTimeout(ctx, config.Retry.fetchTimeout())
+		defer cancel()
+
+		if robots != nil && !robots.allowed(job.url) {
+			data, err := robotsDeniedWARC(e.Name, job.url.String())
 			if err != nil {
-				// Non-connection errors (e.g. WARC writes?) - log and give up
-				log.Printf("getHTTP error: %s\n", err)
-				return
+				log.Printf("building robots-denied record for %q: %s\n", job.url, err)
+				atomic.AddInt64(&stats.Failed, 1)
+				return nil
 			}
-			//log.Printf("++ got result for %q, saving\n", url.String())
-			// Note that we use ctx here, not reqCtx, as we save even on reqCtx timeout
-			saveObject(ctx, bucketOut, prefix, name, data)
-		}(name, url)
-
-		line++
-		if sleep > 0 {
-			time.Sleep(sleep)
+			logSaveErr(save(ctx, backendOut, prefix, job.name, data, stats), job.url)
+			return nil
+		}
+
+		// Wait for our turn under the global and per-host rate limits
+		// before firing the GET.
+		if err := limiter.wait(reqCtx, job.url.Host); err != nil {
+			log.Printf("rate limiter wait for %q: %s\n", job.url, err)
+			atomic.AddInt64(&stats.Failed, 1)
+			return nil
+		}
+
+		// getHTTP almost always returns success - most errors are captured in data
+		data, attempts, err := getHTTP(reqCtx, h.HTTPClient, resolver, config.Retry, job.url, e.Name)
+		if err != nil {
+			log.Printf("getHTTP for %q: %s\n", job.url, err)
+			atomic.AddInt64(&stats.Failed, 1)
+			return nil
+		}
+		if attempts > 1 {
+			atomic.AddInt64(&stats.Retried, int64(attempts-1))
 		}
+		logSaveErr(save(ctx, backendOut, prefix, job.name, data, stats), job.url)
+		return nil
 	}
 
-	// Wait until all clients have finished i.e. when the clients channel is full again
-	for len(sem) > 0 {
-		time.Sleep(1 * time.Second)
+	pool := NewPool(ctx, config.Concurrency, stats, process)
+
+	dispatched := 0
+	for i, url := range urls {
+		if i%100 == 0 {
+			log.Printf("%s [%d] %s\n", e.Name, i, url.String())
+		}
+		if err := pool.Submit(fetchJob{name: objectName(config.NameFormat, url), url: url}); err != nil {
+			log.Printf("%s: stopped dispatching after %d/%d URLs: %s\n", e.Name, dispatched, len(urls), err)
+			break
+		}
+		dispatched++
 	}
-	log.Printf("%s all clients completed, cleaning up\n", e.Name)
+	pool.Close()
+	poolErr := pool.Wait()
+	log.Printf("%s all workers completed, cleaning up\n", e.Name)
 
-	// On completion, delete our url input object
-	deleteObject(ctx, bucketIn, e.Name)
+	if poolErr != nil {
+		log.Printf("%s: %s\n", e.Name, poolErr)
+	}
 
-	log.Printf("%s execution completed\n", e.Name)
+	// Only delete the input uri-list once every URL in it was dispatched
+	// and no worker hit a non-recoverable error - a partial run must leave
+	// the source in place, or the undispatched work is lost for good.
+	if dispatched == len(urls) && poolErr == nil {
+		deleteObject(ctx, backendIn, e.Name)
+	} else {
+		log.Printf("%s: not deleting input, run was incomplete\n", e.Name)
+	}
+
+	log.Printf("%s execution completed: %+v\n", e.Name, *stats)
+	return stats, poolErr
+}
+
+// save writes data to name on backend, updating stats' Succeeded/Failed and
+// BytesWritten counters to match the outcome.
+func save(ctx context.Context, backend Backend, prefix, name string, data *bytes.Buffer, stats *RunStats) error {
+	n, err := saveObject(ctx, backend, prefix, name, data)
+	if err != nil {
+		atomic.AddInt64(&stats.Failed, 1)
+		return fmt.Errorf("saving %q: %w", name, err)
+	}
+	atomic.AddInt64(&stats.BytesWritten, n)
+	atomic.AddInt64(&stats.Succeeded, 1)
 	return nil
 }
+
+// logSaveErr logs a save failure for url. save has already updated
+// stats.Failed, so callers just need this not to propagate any further.
+func logSaveErr(err error, url *neturl.URL) {
+	if err != nil {
+		log.Printf("%q: %s\n", url, err)
+	}
+}
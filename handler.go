@@ -0,0 +1,61 @@
+package cfgul
+
+import (
+	"context"
+	"net/http"
+
+	"cloud.google.com/go/storage"
+)
+
+// Option configures a Handler, overriding a default built from the
+// environment. Options exist primarily so tests (and non-GCF callers) can
+// inject fakes/alternate transports without GetURIList's internals needing
+// to know about them.
+type Option func(*Handler)
+
+// WithStorageClient sets the *storage.Client used to build "gs://" backends,
+// instead of one constructed with storage.NewClient(ctx). Typically built
+// with option.WithHTTPClient pointing at an alternate transport, e.g. one
+// that talks to an in-process fake-gcs-server.
+func WithStorageClient(client *storage.Client) Option {
+	return func(h *Handler) { h.storageClient = client }
+}
+
+// WithHTTPClient sets the *http.Client used for outbound fetches, instead of
+// a bare http.Client{}. Typically built pointing at an httptest.Server.
+func WithHTTPClient(client *http.Client) Option {
+	return func(h *Handler) { h.HTTPClient = client }
+}
+
+// Handler holds the dependencies GetURIList needs to process one GCSEvent.
+// It exists so those dependencies (storage and HTTP clients) can be injected
+// rather than constructed internally, making the package testable.
+type Handler struct {
+	Config Config
+
+	HTTPClient *http.Client
+
+	storageClient *storage.Client
+}
+
+// NewHandler builds a Handler from the environment (via newConfig), applying
+// opts on top of the defaults.
+func NewHandler(opts ...Option) *Handler {
+	h := &Handler{
+		Config:     newConfig(),
+		HTTPClient: &http.Client{},
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+// backend resolves rawBackend ("gs", "s3", ...) and location to a Backend,
+// reusing h.storageClient for "gs" backends when one has been injected.
+func (h *Handler) backend(ctx context.Context, rawBackend, location string) (Backend, error) {
+	if rawBackend == "gs" && h.storageClient != nil {
+		return newGCSBackendFromClient(h.storageClient, location), nil
+	}
+	return ParseBackendURL(ctx, rawBackend+"://"+location)
+}
@@ -0,0 +1,261 @@
+package cfgul
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	neturl "net/url"
+	"testing"
+
+	"github.com/fsouza/fake-gcs-server/fakestorage"
+	"github.com/gavincarr/warc"
+)
+
+// newTestHandler builds a Handler wired up to server (for the "gs" backend)
+// and httpClient (for outbound fetches), with GUL_OUTPUT_BUCKET set to
+// outputBucket and retries trimmed to a single attempt so failure tests
+// don't sit through backoff sleeps.
+func newTestHandler(t *testing.T, server *fakestorage.Server, httpClient *http.Client, outputBucket string) *Handler {
+	t.Helper()
+	t.Setenv("GUL_OUTPUT_BUCKET", outputBucket)
+	h := NewHandler(WithStorageClient(server.Client()), WithHTTPClient(httpClient))
+	h.Config.Retry.MaxAttempts = 1
+	return h
+}
+
+// readObject returns the stored (still gzipped) content of bucket/name from server,
+// failing the test if the object doesn't exist.
+func readObject(t *testing.T, server *fakestorage.Server, bucket, name string) []byte {
+	t.Helper()
+	obj, err := server.GetObject(bucket, name)
+	if err != nil {
+		t.Fatalf("GetObject(%q, %q): %s", bucket, name, err)
+	}
+	return obj.Content
+}
+
+// mustParseURL parses rawurl, failing the test on error.
+func mustParseURL(t *testing.T, rawurl string) *neturl.URL {
+	t.Helper()
+	url, err := neturl.Parse(rawurl)
+	if err != nil {
+		t.Fatalf("url.Parse(%q): %s", rawurl, err)
+	}
+	return url
+}
+
+// readWARCRecords gzip-decompresses and parses data as a WARC file,
+// returning its records in order.
+func readWARCRecords(t *testing.T, data []byte) []*warc.Record {
+	t.Helper()
+	r, err := warc.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("warc.NewReader: %s", err)
+	}
+	defer r.Close()
+
+	var records []*warc.Record
+	for {
+		record, err := r.ReadRecord()
+		if err != nil {
+			break
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestRunWithStatsSuccess(t *testing.T) {
+	var gotUserAgent string
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotUserAgent = r.Header.Get("User-Agent")
+		fmt.Fprint(w, "hello world")
+	}))
+	defer target.Close()
+
+	inputBucket, outputBucket, inputName := "input-bucket", "output-bucket", "urls.txt"
+	server := fakestorage.NewServer([]fakestorage.Object{
+		{
+			ObjectAttrs: fakestorage.ObjectAttrs{BucketName: inputBucket, Name: inputName},
+			Content:     []byte(target.URL + "\n"),
+		},
+	})
+	defer server.Stop()
+	server.CreateBucket(outputBucket)
+
+	h := newTestHandler(t, server, target.Client(), outputBucket)
+
+	stats, err := h.RunWithStats(context.Background(), GCSEvent{Bucket: inputBucket, Name: inputName})
+	if err != nil {
+		t.Fatalf("RunWithStats: %s", err)
+	}
+	if stats.Succeeded != 1 || stats.Failed != 0 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	name := objectName(GUL_NAME_FORMAT, mustParseURL(t, target.URL))
+	data := readObject(t, server, outputBucket, name)
+	records := readWARCRecords(t, data)
+	if len(records) != 3 {
+		t.Fatalf("got %d WARC records, want 3 (warcinfo, request, response)", len(records))
+	}
+	if got := records[0].Header.Get("warc-type"); got != "warcinfo" {
+		t.Errorf("records[0] warc-type = %q, want warcinfo", got)
+	}
+	if got := records[1].Header.Get("warc-type"); got != "request" {
+		t.Errorf("records[1] warc-type = %q, want request", got)
+	}
+	if got := records[2].Header.Get("warc-type"); got != "response" {
+		t.Errorf("records[2] warc-type = %q, want response", got)
+	}
+	if got := records[2].Header.Get("warc-target-uri"); got != target.URL {
+		t.Errorf("response warc-target-uri = %q, want %q", got, target.URL)
+	}
+	if gotUserAgent != geturilistUserAgent {
+		t.Errorf("outbound User-Agent = %q, want %q", gotUserAgent, geturilistUserAgent)
+	}
+
+	// The request has an empty body, so its payload digest must be the
+	// digest of zero bytes, not a copy of the (non-empty) block digest.
+	if blockDigest, payloadDigest := records[1].Header.Get("warc-block-digest"), records[1].Header.Get("warc-payload-digest"); payloadDigest != digest(nil) || payloadDigest == blockDigest {
+		t.Errorf("request warc-payload-digest = %q, warc-block-digest = %q, want payload digest %q and the two to differ", payloadDigest, blockDigest, digest(nil))
+	}
+
+	// A fully-dispatched run with no worker errors deletes the input list.
+	if _, err := server.GetObject(inputBucket, inputName); err == nil {
+		t.Errorf("input object %q still exists after a successful run", inputName)
+	}
+}
+
+func TestRunWithStatsNameFormats(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello world")
+	}))
+	defer target.Close()
+	url := mustParseURL(t, target.URL)
+
+	cases := []struct {
+		nameFormat string
+		wantName   string
+	}{
+		{"sha1", fmt.Sprintf("%x.warc.gz", sha1.Sum([]byte(url.String())))},
+		{"url", neturl.PathEscape(url.String()) + ".warc.gz"},
+		{"hostname", url.Hostname() + ".warc.gz"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.nameFormat, func(t *testing.T) {
+			inputBucket, outputBucket, inputName := "input-bucket", "output-bucket-"+c.nameFormat, "urls.txt"
+			server := fakestorage.NewServer([]fakestorage.Object{
+				{
+					ObjectAttrs: fakestorage.ObjectAttrs{BucketName: inputBucket, Name: inputName},
+					Content:     []byte(target.URL + "\n"),
+				},
+			})
+			defer server.Stop()
+			server.CreateBucket(outputBucket)
+
+			h := newTestHandler(t, server, target.Client(), outputBucket)
+			h.Config.NameFormat = c.nameFormat
+
+			if _, err := h.RunWithStats(context.Background(), GCSEvent{Bucket: inputBucket, Name: inputName}); err != nil {
+				t.Fatalf("RunWithStats: %s", err)
+			}
+			if _, err := server.GetObject(outputBucket, c.wantName); err != nil {
+				t.Fatalf("GetObject(%q, %q): %s", outputBucket, c.wantName, err)
+			}
+		})
+	}
+}
+
+func TestRunWithStatsGzipInput(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello world")
+	}))
+	defer target.Close()
+
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	fmt.Fprintf(gw, "%s\n", target.URL)
+	if err := gw.Close(); err != nil {
+		t.Fatalf("gzip.Close: %s", err)
+	}
+
+	inputBucket, outputBucket, inputName := "input-bucket", "output-bucket", "urls.txt.gz"
+	server := fakestorage.NewServer([]fakestorage.Object{
+		{
+			ObjectAttrs: fakestorage.ObjectAttrs{BucketName: inputBucket, Name: inputName},
+			Content:     gzipped.Bytes(),
+		},
+	})
+	defer server.Stop()
+	server.CreateBucket(outputBucket)
+
+	h := newTestHandler(t, server, target.Client(), outputBucket)
+
+	stats, err := h.RunWithStats(context.Background(), GCSEvent{Bucket: inputBucket, Name: inputName})
+	if err != nil {
+		t.Fatalf("RunWithStats: %s", err)
+	}
+	if stats.Succeeded != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestRunWithStatsFetchFailure(t *testing.T) {
+	// A client that always fails to connect, so every attempt records an
+	// error rather than a response.
+	brokenClient := &http.Client{
+		Transport: roundTripFunc(func(*http.Request) (*http.Response, error) {
+			return nil, fmt.Errorf("connection refused")
+		}),
+	}
+
+	inputBucket, outputBucket, inputName := "input-bucket", "output-bucket", "urls.txt"
+	badURL := "http://example.invalid/"
+	server := fakestorage.NewServer([]fakestorage.Object{
+		{
+			ObjectAttrs: fakestorage.ObjectAttrs{BucketName: inputBucket, Name: inputName},
+			Content:     []byte(badURL + "\n"),
+		},
+	})
+	defer server.Stop()
+	server.CreateBucket(outputBucket)
+
+	h := newTestHandler(t, server, brokenClient, outputBucket)
+
+	stats, err := h.RunWithStats(context.Background(), GCSEvent{Bucket: inputBucket, Name: inputName})
+	if err != nil {
+		t.Fatalf("RunWithStats: %s", err)
+	}
+	if stats.Succeeded != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	name := objectName(GUL_NAME_FORMAT, mustParseURL(t, badURL))
+	data := readObject(t, server, outputBucket, name)
+	records := readWARCRecords(t, data)
+	if len(records) != 3 {
+		t.Fatalf("got %d WARC records, want 3 (warcinfo, request, response)", len(records))
+	}
+	if got := records[1].Header.Get("warc-type"); got != "request" {
+		t.Errorf("records[1] warc-type = %q, want request", got)
+	}
+	if got := records[2].Header.Get("warc-type"); got != "response" {
+		t.Errorf("records[2] warc-type = %q, want response", got)
+	}
+	buf := new(bytes.Buffer)
+	buf.ReadFrom(records[2].Content)
+	if got := buf.String(); !bytes.Contains(buf.Bytes(), []byte("599")) {
+		t.Errorf("synthetic response content = %q, want it to mention 599", got)
+	}
+}
+
+// roundTripFunc adapts a function to the http.RoundTripper interface.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
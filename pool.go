@@ -0,0 +1,105 @@
+package cfgul
+
+import (
+	"context"
+	neturl "net/url"
+	"sync/atomic"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// RunStats holds the per-run metrics a Pool collects while processing a
+// run's URLs, so callers running this outside GCF can log or export them.
+type RunStats struct {
+	Attempted    int64
+	Succeeded    int64
+	Retried      int64
+	Failed       int64
+	BytesWritten int64
+}
+
+// fetchJob is one unit of work submitted to a Pool: fetch url and save the
+// result under name.
+type fetchJob struct {
+	name string
+	url  *neturl.URL
+}
+
+// Pool runs fetchJobs across a fixed number of long-lived workers, using an
+// errgroup.Group so cancelling ctx aborts in-flight work across every
+// worker at once rather than leaving the caller to poll a semaphore.
+// process is expected to handle its own per-job failures (logging them and
+// updating stats) and only ever return an error for something that should
+// abort the whole run; a single bad URL must never take down the others.
+type Pool struct {
+	jobs    chan fetchJob
+	group   *errgroup.Group
+	ctx     context.Context
+	stats   *RunStats
+	process func(ctx context.Context, job fetchJob, stats *RunStats) error
+}
+
+// NewPool starts a Pool of size long-lived workers, each running process on
+// jobs submitted via Submit until Close is called (or ctx is done). stats'
+// Attempted counter is updated as jobs are picked up; process itself is
+// responsible for Succeeded/Failed/Retried/BytesWritten, since only it knows
+// whether a given outcome (a real response, a robots skip, a write failure)
+// counts as which.
+func NewPool(ctx context.Context, size int, stats *RunStats, process func(ctx context.Context, job fetchJob, stats *RunStats) error) *Pool {
+	if size < 1 {
+		size = 1
+	}
+	group, gctx := errgroup.WithContext(ctx)
+	p := &Pool{
+		jobs:    make(chan fetchJob),
+		group:   group,
+		ctx:     gctx,
+		stats:   stats,
+		process: process,
+	}
+	for i := 0; i < size; i++ {
+		group.Go(p.worker)
+	}
+	return p
+}
+
+func (p *Pool) worker() error {
+	for {
+		select {
+		case <-p.ctx.Done():
+			return p.ctx.Err()
+		case job, ok := <-p.jobs:
+			if !ok {
+				return nil
+			}
+			atomic.AddInt64(&p.stats.Attempted, 1)
+			if err := p.process(p.ctx, job, p.stats); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Submit enqueues job for processing, blocking until a worker picks it up.
+// It returns the pool's context error, without enqueuing, once the pool has
+// been cancelled (by ctx or by a worker's non-recoverable error).
+func (p *Pool) Submit(job fetchJob) error {
+	select {
+	case p.jobs <- job:
+		return nil
+	case <-p.ctx.Done():
+		return p.ctx.Err()
+	}
+}
+
+// Close stops accepting new jobs. Workers drain whatever is already queued
+// and then exit.
+func (p *Pool) Close() {
+	close(p.jobs)
+}
+
+// Wait blocks until every worker has exited, returning the first
+// non-recoverable error any of them returned, if any.
+func (p *Pool) Wait() error {
+	return p.group.Wait()
+}
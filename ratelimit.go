@@ -0,0 +1,135 @@
+package cfgul
+
+import (
+	"context"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// Rate limit config defaults. A rate of 0 means "unlimited" - no limiter is
+// applied - so existing deployments that don't set these see no throttling.
+const (
+	GUL_HOST_RPS       = 0.0
+	GUL_HOST_BURST     = 1
+	GUL_GLOBAL_RPS     = 0.0
+	GUL_RESPECT_ROBOTS = false
+)
+
+// RateLimitConfig holds our per-host/global rate limiting settings
+type RateLimitConfig struct {
+	HostRPS       float64
+	HostBurst     int
+	GlobalRPS     float64
+	RespectRobots bool
+}
+
+// newRateLimitConfig returns a RateLimitConfig based on the environment and defaults
+func newRateLimitConfig() RateLimitConfig {
+	config := RateLimitConfig{
+		HostRPS:       GUL_HOST_RPS,
+		HostBurst:     GUL_HOST_BURST,
+		GlobalRPS:     GUL_GLOBAL_RPS,
+		RespectRobots: GUL_RESPECT_ROBOTS,
+	}
+	if hostRPSStr := os.Getenv("GUL_HOST_RPS"); hostRPSStr != "" {
+		hostRPS, err := strconv.ParseFloat(hostRPSStr, 64)
+		if err != nil {
+			log.Fatalf("parsing GUL_HOST_RPS %q: %s\n", hostRPSStr, err)
+		}
+		config.HostRPS = hostRPS
+	}
+	if hostBurstStr := os.Getenv("GUL_HOST_BURST"); hostBurstStr != "" {
+		hostBurst, err := strconv.Atoi(hostBurstStr)
+		if err != nil {
+			log.Fatalf("parsing GUL_HOST_BURST %q: %s\n", hostBurstStr, err)
+		}
+		config.HostBurst = hostBurst
+	}
+	if globalRPSStr := os.Getenv("GUL_GLOBAL_RPS"); globalRPSStr != "" {
+		globalRPS, err := strconv.ParseFloat(globalRPSStr, 64)
+		if err != nil {
+			log.Fatalf("parsing GUL_GLOBAL_RPS %q: %s\n", globalRPSStr, err)
+		}
+		config.GlobalRPS = globalRPS
+	}
+	if respectRobotsStr := os.Getenv("GUL_RESPECT_ROBOTS"); respectRobotsStr != "" {
+		respectRobots, err := strconv.ParseBool(respectRobotsStr)
+		if err != nil {
+			log.Fatalf("parsing GUL_RESPECT_ROBOTS %q: %s\n", respectRobotsStr, err)
+		}
+		config.RespectRobots = respectRobots
+	}
+	return config
+}
+
+// hostLimiter dispenses per-host rate.Limiters, plus an overall global one,
+// so a busy host is throttled without slowing down requests to other hosts.
+// Limiters are created lazily, on a host's first request.
+type hostLimiter struct {
+	mu     sync.Mutex
+	byHost map[string]*rate.Limiter
+	global *rate.Limiter
+	rps    float64
+	burst  int
+}
+
+// newHostLimiter builds a hostLimiter from cfg. Zero rates disable the
+// corresponding limiter entirely (wait becomes a no-op for it).
+func newHostLimiter(cfg RateLimitConfig) *hostLimiter {
+	l := &hostLimiter{
+		byHost: make(map[string]*rate.Limiter),
+		rps:    cfg.HostRPS,
+		burst:  cfg.HostBurst,
+	}
+	if cfg.GlobalRPS > 0 {
+		l.global = rate.NewLimiter(rate.Limit(cfg.GlobalRPS), burstFor(cfg.GlobalRPS))
+	}
+	return l
+}
+
+// burstFor picks a sensible default burst for a limiter configured only
+// with a rate: enough to let at least one request through immediately.
+func burstFor(rps float64) int {
+	if b := int(rps); b > 1 {
+		return b
+	}
+	return 1
+}
+
+// forHost returns host's limiter, creating it on first use. Returns nil if
+// per-host limiting is disabled (HostRPS <= 0).
+func (l *hostLimiter) forHost(host string) *rate.Limiter {
+	if l.rps <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if lim, ok := l.byHost[host]; ok {
+		return lim
+	}
+	burst := l.burst
+	if burst < 1 {
+		burst = 1
+	}
+	lim := rate.NewLimiter(rate.Limit(l.rps), burst)
+	l.byHost[host] = lim
+	return lim
+}
+
+// wait blocks until both the global limiter (if any) and host's limiter (if
+// any) allow another request, or ctx is done.
+func (l *hostLimiter) wait(ctx context.Context, host string) error {
+	if l.global != nil {
+		if err := l.global.Wait(ctx); err != nil {
+			return err
+		}
+	}
+	if lim := l.forHost(host); lim != nil {
+		return lim.Wait(ctx)
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package cfgul
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Retry config defaults
+const (
+	GUL_MAX_ATTEMPTS    = 3
+	GUL_RETRY_MIN_DELAY = 1 * time.Second
+	GUL_RETRY_MAX_DELAY = 30 * time.Second
+	GUL_RETRY_JITTER    = 0.2
+
+	// attemptTimeout bounds a single attempt, so one slow/hanging attempt
+	// can't eat the whole per-URL budget; retries get their own fresh shot.
+	attemptTimeout = 10 * time.Second
+)
+
+// RetryConfig holds our retry/backoff settings
+type RetryConfig struct {
+	MaxAttempts int
+	MinDelay    time.Duration
+	MaxDelay    time.Duration
+	Jitter      float64
+}
+
+// newRetryConfig returns a RetryConfig based on the environment and defaults
+func newRetryConfig() RetryConfig {
+	config := RetryConfig{
+		MaxAttempts: GUL_MAX_ATTEMPTS,
+		MinDelay:    GUL_RETRY_MIN_DELAY,
+		MaxDelay:    GUL_RETRY_MAX_DELAY,
+		Jitter:      GUL_RETRY_JITTER,
+	}
+	if maxAttemptsStr := os.Getenv("GUL_MAX_ATTEMPTS"); maxAttemptsStr != "" {
+		maxAttempts, err := strconv.Atoi(maxAttemptsStr)
+		if err != nil {
+			log.Fatalf("parsing GUL_MAX_ATTEMPTS %q: %s\n", maxAttemptsStr, err)
+		}
+		config.MaxAttempts = maxAttempts
+	}
+	if minDelayStr := os.Getenv("GUL_RETRY_MIN_DELAY"); minDelayStr != "" {
+		minDelay, err := time.ParseDuration(minDelayStr)
+		if err != nil {
+			log.Fatalf("parsing GUL_RETRY_MIN_DELAY %q: %s\n", minDelayStr, err)
+		}
+		config.MinDelay = minDelay
+	}
+	if maxDelayStr := os.Getenv("GUL_RETRY_MAX_DELAY"); maxDelayStr != "" {
+		maxDelay, err := time.ParseDuration(maxDelayStr)
+		if err != nil {
+			log.Fatalf("parsing GUL_RETRY_MAX_DELAY %q: %s\n", maxDelayStr, err)
+		}
+		config.MaxDelay = maxDelay
+	}
+	if jitterStr := os.Getenv("GUL_RETRY_JITTER"); jitterStr != "" {
+		jitter, err := strconv.ParseFloat(jitterStr, 64)
+		if err != nil {
+			log.Fatalf("parsing GUL_RETRY_JITTER %q: %s\n", jitterStr, err)
+		}
+		config.Jitter = jitter
+	}
+	return config
+}
+
+// fetchTimeout returns the overall per-URL budget that must cover every
+// attempt retry allows, including the backoff sleeps between them.
+func (r RetryConfig) fetchTimeout() time.Duration {
+	attempts := r.MaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	return time.Duration(attempts) * (attemptTimeout + r.MaxDelay)
+}
+
+// attemptResult records the outcome of a single fetch attempt, preserved in
+// the output WARC as an X-Attempt header on the final record.
+type attemptResult struct {
+	n      int
+	status string
+	err    error
+}
+
+func (a attemptResult) String() string {
+	if a.err != nil {
+		return fmt.Sprintf("n=%d error=%q", a.n, a.err.Error())
+	}
+	return fmt.Sprintf("n=%d status=%q", a.n, a.status)
+}
+
+// retryableError reports whether err justifies another attempt: a temporary
+// net.Error, or attemptCtx (not the outer reqCtx) having hit its deadline.
+func retryableError(err error, attemptCtx context.Context) bool {
+	if attemptCtx.Err() == context.DeadlineExceeded {
+		return true
+	}
+	var netErr net.Error
+	if ok := asNetError(err, &netErr); ok {
+		return netErr.Temporary()
+	}
+	return false
+}
+
+// asNetError is a small errors.As wrapper kept local so callers don't need
+// to import "errors" just for this one check.
+func asNetError(err error, target *net.Error) bool {
+	for err != nil {
+		if ne, ok := err.(net.Error); ok {
+			*target = ne
+			return true
+		}
+		unwrapper, ok := err.(interface{ Unwrap() error })
+		if !ok {
+			return false
+		}
+		err = unwrapper.Unwrap()
+	}
+	return false
+}
+
+// retryableStatus reports whether resp is a 5xx carrying a parseable
+// Retry-After, and if so the delay it asks for. A 5xx whose Retry-After is
+// absent or unparseable is reported as not retryable.
+func retryableStatus(resp *http.Response) (bool, time.Duration) {
+	if resp.StatusCode < 500 || resp.StatusCode >= 600 {
+		return false, 0
+	}
+	retryAfter := resp.Header.Get("Retry-After")
+	if retryAfter == "" {
+		return false, 0
+	}
+	if secs, err := strconv.Atoi(retryAfter); err == nil {
+		return true, time.Duration(secs) * time.Second
+	}
+	if when, err := http.ParseTime(retryAfter); err == nil {
+		return true, time.Until(when)
+	}
+	return false, 0
+}
+
+// nextDelay doubles delay (capped at max) and applies +/-jitter.
+func nextDelay(delay, max time.Duration, jitter float64) time.Duration {
+	delay *= 2
+	if delay > max {
+		delay = max
+	}
+	if jitter > 0 {
+		spread := float64(delay) * jitter
+		delay += time.Duration(spread*rand.Float64()*2 - spread)
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	return delay
+}
+
+// sleep pauses for delay, or until ctx is cancelled, whichever comes first.
+func sleep(ctx context.Context, delay time.Duration) {
+	if delay <= 0 {
+		return
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
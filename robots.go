@@ -0,0 +1,78 @@
+package cfgul
+
+import (
+	"net/http"
+	neturl "net/url"
+	"sync"
+
+	"github.com/temoto/robotstxt"
+)
+
+// geturilistUserAgent is the User-Agent we declare, both on outbound
+// fetches and when evaluating robots.txt groups against it.
+const geturilistUserAgent = "cloudfunc-geturilist"
+
+// robotsCache fetches and caches each host's robots.txt policy, so later
+// URLs on a host reuse it rather than fetching it again. The lock is not held
+// during the fetch, so workers that reach a new host at the same time may
+// each fetch its robots.txt once.
+type robotsCache struct {
+	client *http.Client
+
+	mu     sync.Mutex
+	groups map[string]*robotstxt.Group
+}
+
+func newRobotsCache(client *http.Client) *robotsCache {
+	return &robotsCache{client: client, groups: make(map[string]*robotstxt.Group)}
+}
+
+// allowed reports whether url's path may be fetched under host's robots.txt
+// policy for our User-Agent. A missing or unparseable robots.txt allows
+// everything, per the usual robots.txt convention.
+func (c *robotsCache) allowed(url *neturl.URL) bool {
+	group := c.groupFor(url)
+	if group == nil {
+		return true
+	}
+	return group.Test(url.Path)
+}
+
+func (c *robotsCache) groupFor(url *neturl.URL) *robotstxt.Group {
+	host := url.Host
+
+	c.mu.Lock()
+	group, seen := c.groups[host]
+	c.mu.Unlock()
+	if seen {
+		return group
+	}
+
+	group = c.fetchGroup(url)
+
+	c.mu.Lock()
+	c.groups[host] = group
+	c.mu.Unlock()
+	return group
+}
+
+func (c *robotsCache) fetchGroup(url *neturl.URL) *robotstxt.Group {
+	robotsURL := neturl.URL{Scheme: url.Scheme, Host: url.Host, Path: "/robots.txt"}
+	req, err := http.NewRequest("GET", robotsURL.String(), nil)
+	if err != nil {
+		return nil
+	}
+	req.Header.Set("User-Agent", geturilistUserAgent)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil
+	}
+	defer resp.Body.Close()
+
+	data, err := robotstxt.FromResponse(resp)
+	if err != nil {
+		return nil
+	}
+	return data.FindGroup(geturilistUserAgent)
+}
@@ -0,0 +1,184 @@
+package cfgul
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/base32"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gavincarr/warc"
+	"github.com/google/uuid"
+)
+
+// Version is the package version recorded in each run's warcinfo record.
+var Version = "dev"
+
+const (
+	warcSoftware   = "cloudfunc-geturilist"
+	warcOperator   = "gavincarr/cloudfunc-geturilist"
+	warcFormat     = "WARC File Format 1.1"
+	warcConformsTo = "https://iipc.github.io/warc-specifications/specifications/warc-format/warc-1.1/"
+)
+
+// hostResolver caches the resolved IP address for each host it is asked to
+// resolve, since WARC-IP-Address is recorded against every response but a
+// run typically hits the same host many times.
+type hostResolver struct {
+	mu    sync.Mutex
+	cache map[string]string
+}
+
+func newHostResolver() *hostResolver {
+	return &hostResolver{cache: make(map[string]string)}
+}
+
+// resolve returns the first resolved address for host, or "" if resolution
+// fails (in which case WARC-IP-Address is simply omitted).
+func (r *hostResolver) resolve(host string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if ip, ok := r.cache[host]; ok {
+		return ip
+	}
+	ip := ""
+	if addrs, err := net.LookupHost(host); err == nil && len(addrs) > 0 {
+		ip = addrs[0]
+	}
+	r.cache[host] = ip
+	return ip
+}
+
+// newRecordID returns a fresh WARC-Record-ID, a urn:uuid URI as required by
+// the WARC 1.1 spec (section 5.1).
+func newRecordID() string {
+	return "<urn:uuid:" + uuid.New().String() + ">"
+}
+
+// warcDate returns the current time formatted as required for WARC-Date:
+// RFC3339, UTC.
+func warcDate() string {
+	return time.Now().UTC().Format(time.RFC3339)
+}
+
+// digest returns a WARC-Block-Digest/WARC-Payload-Digest value for data, in
+// the "sha1:<base32>" form the spec recommends.
+func digest(data []byte) string {
+	sum := sha1.Sum(data)
+	return "sha1:" + base32.StdEncoding.EncodeToString(sum[:])
+}
+
+// newWarcinfoRecord builds the warcinfo record written at the start of each
+// output .warc.gz file, identifying the software that produced it and the
+// uri-list object it was generated from.
+func newWarcinfoRecord(sourceURIList string) *warc.Record {
+	var content bytes.Buffer
+	fmt.Fprintf(&content, "software: %s/%s\r\n", warcSoftware, Version)
+	fmt.Fprintf(&content, "format: %s\r\n", warcFormat)
+	fmt.Fprintf(&content, "conformsTo: %s\r\n", warcConformsTo)
+	fmt.Fprintf(&content, "operator: %s\r\n", warcOperator)
+	fmt.Fprintf(&content, "source-uri-list: %s\r\n", sourceURIList)
+
+	record := warc.NewRecord()
+	record.Header.Set("warc-type", "warcinfo")
+	record.Header.Set("warc-record-id", newRecordID())
+	record.Header.Set("warc-date", warcDate())
+	record.Header.Set("content-type", "application/warc-fields")
+	record.Header.Set("content-length", strconv.Itoa(content.Len()))
+	record.Header.Set("warc-block-digest", digest(content.Bytes()))
+	record.Content = &content
+	return record
+}
+
+// requestSnapshot is the pre-serialized form of an outbound HTTP request,
+// captured before it is sent so the request record can be built regardless
+// of what the response record ends up looking like.
+type requestSnapshot struct {
+	urlStr  string
+	content *bytes.Buffer
+}
+
+// snapshotRequest serializes req (method, headers and body) for later use
+// building a WARC request record.
+func snapshotRequest(req *http.Request) (*requestSnapshot, error) {
+	var content bytes.Buffer
+	if err := req.Write(&content); err != nil {
+		return nil, err
+	}
+	return &requestSnapshot{urlStr: req.URL.String(), content: &content}, nil
+}
+
+// newRequestRecord builds the WARC request record for req (the outbound
+// method, headers and - for our GETs - empty body), returning both the
+// record and its WARC-Record-ID, so the corresponding response record can
+// reference it via WARC-Concurrent-To. WARC-Block-Digest covers content (the
+// full serialized request); WARC-Payload-Digest covers the request body
+// alone, which for our GETs is always empty.
+func newRequestRecord(req *requestSnapshot, ip string) (*warc.Record, string) {
+	content := req.content
+
+	recordID := newRecordID()
+	record := warc.NewRecord()
+	record.Header.Set("warc-type", "request")
+	record.Header.Set("warc-record-id", recordID)
+	record.Header.Set("warc-date", warcDate())
+	record.Header.Set("warc-target-uri", req.urlStr)
+	record.Header.Set("content-type", "application/http;msgtype=request")
+	record.Header.Set("content-length", strconv.Itoa(content.Len()))
+	record.Header.Set("warc-block-digest", digest(content.Bytes()))
+	record.Header.Set("warc-payload-digest", digest(nil))
+	if ip != "" {
+		record.Header.Set("warc-ip-address", ip)
+	}
+	record.Content = content
+	return record, recordID
+}
+
+// newResponseRecord builds a WARC response record. content is the full
+// serialized HTTP response (status line, headers and body); payload is the
+// body alone, used for WARC-Payload-Digest. concurrentTo, if non-empty, is
+// the WARC-Record-ID of the request record this response belongs to.
+func newResponseRecord(content *bytes.Buffer, payload []byte, targetURI, ip, concurrentTo string) *warc.Record {
+	record := warc.NewRecord()
+	record.Header.Set("warc-type", "response")
+	record.Header.Set("warc-record-id", newRecordID())
+	record.Header.Set("warc-date", warcDate())
+	record.Header.Set("warc-target-uri", targetURI)
+	record.Header.Set("content-type", "application/http;msgtype=response")
+	record.Header.Set("content-length", strconv.Itoa(content.Len()))
+	record.Header.Set("warc-block-digest", digest(content.Bytes()))
+	record.Header.Set("warc-payload-digest", digest(payload))
+	if ip != "" {
+		record.Header.Set("warc-ip-address", ip)
+	}
+	if concurrentTo != "" {
+		record.Header.Set("warc-concurrent-to", concurrentTo)
+	}
+	record.Content = content
+	return record
+}
+
+// writeWARC gzips and serializes records, in order, into a single .warc.gz
+// buffer ready to be saved to the output backend.
+func writeWARC(records ...*warc.Record) (*bytes.Buffer, error) {
+	var b bytes.Buffer
+
+	gzwriter := gzip.NewWriter(&b)
+	writer := warc.NewWriter(gzwriter)
+
+	for _, record := range records {
+		if _, err := writer.WriteRecord(record); err != nil {
+			return nil, err
+		}
+	}
+	if err := gzwriter.Close(); err != nil {
+		return nil, err
+	}
+
+	return &b, nil
+}